@@ -0,0 +1,176 @@
+// Copyright (c) 2015-2016, NVIDIA CORPORATION. All rights reserved.
+
+// Package exporter wires nvml.Device.Status into a prometheus.Collector.
+package exporter
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"nvml"
+)
+
+var labelNames = []string{"uuid", "minor", "model", "pci_bus_id", "mig_gi", "mig_ci"}
+
+var (
+	utilizationDesc = prometheus.NewDesc(
+		"nvidia_gpu_utilization", "GPU utilization percent.", labelNames, nil)
+	memoryUsedDesc = prometheus.NewDesc(
+		"nvidia_gpu_memory_used_bytes", "GPU global memory used, in bytes.", labelNames, nil)
+	powerDesc = prometheus.NewDesc(
+		"nvidia_gpu_power_watts", "GPU power draw, in watts.", labelNames, nil)
+	temperatureDesc = prometheus.NewDesc(
+		"nvidia_gpu_temperature_celsius", "GPU temperature, in degrees Celsius.", labelNames, nil)
+	pcieThroughputDesc = prometheus.NewDesc(
+		"nvidia_gpu_pcie_throughput_bytes", "PCIe throughput, in bytes per second.",
+		append(append([]string{}, labelNames...), "direction"), nil)
+	eccErrorsDesc = prometheus.NewDesc(
+		"nvidia_gpu_ecc_errors_total", "Uncorrected ECC errors.",
+		append(append([]string{}, labelNames...), "location"), nil)
+	processMemoryDesc = prometheus.NewDesc(
+		"nvidia_gpu_process_memory_bytes", "Memory used by a process on the GPU, in bytes.",
+		append(append([]string{}, labelNames...), "pid", "name"), nil)
+	nvlinkThroughputDesc = prometheus.NewDesc(
+		"nvidia_gpu_nvlink_throughput_bytes_total", "Cumulative NVLink traffic, in bytes.",
+		append(append([]string{}, labelNames...), "link", "peer_pci_bus_id", "direction"), nil)
+)
+
+var minorPattern = regexp.MustCompile(`(?:nvidia|gpu)(\d+)`)
+
+// Collector adapts a fixed set of devices to prometheus.Collector, caching
+// each device's Status for cacheTTL so scraping N times per second doesn't
+// hammer NVML.
+type Collector struct {
+	devices  []*nvml.Device
+	cacheTTL time.Duration
+
+	mu       sync.Mutex
+	cache    map[*nvml.Device]*nvml.DeviceStatus
+	cachedAt map[*nvml.Device]time.Time
+}
+
+// NewCollector returns a Collector for devices. A cacheTTL of zero disables
+// caching and queries NVML on every Collect.
+func NewCollector(devices []*nvml.Device, cacheTTL time.Duration) *Collector {
+	return &Collector{
+		devices:  devices,
+		cacheTTL: cacheTTL,
+		cache:    make(map[*nvml.Device]*nvml.DeviceStatus),
+		cachedAt: make(map[*nvml.Device]time.Time),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- utilizationDesc
+	ch <- memoryUsedDesc
+	ch <- powerDesc
+	ch <- temperatureDesc
+	ch <- pcieThroughputDesc
+	ch <- eccErrorsDesc
+	ch <- processMemoryDesc
+	ch <- nvlinkThroughputDesc
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, d := range c.devices {
+		status, err := c.status(d)
+		if err != nil {
+			continue
+		}
+		labels := labelValues(d)
+
+		ch <- prometheus.MustNewConstMetric(utilizationDesc, prometheus.GaugeValue,
+			float64(status.Utilization.GPU), labels...)
+		ch <- prometheus.MustNewConstMetric(memoryUsedDesc, prometheus.GaugeValue,
+			float64(status.Memory.GlobalUsed)*1024*1024, labels...)
+		if status.Power != nil {
+			ch <- prometheus.MustNewConstMetric(powerDesc, prometheus.GaugeValue,
+				float64(*status.Power), labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(temperatureDesc, prometheus.GaugeValue,
+			float64(status.Temperature), labels...)
+
+		if status.PCI.Throughput != nil {
+			ch <- prometheus.MustNewConstMetric(pcieThroughputDesc, prometheus.GaugeValue,
+				float64(status.PCI.Throughput.RX)*1000*1024, append(append([]string{}, labels...), "rx")...)
+			ch <- prometheus.MustNewConstMetric(pcieThroughputDesc, prometheus.GaugeValue,
+				float64(status.PCI.Throughput.TX)*1000*1024, append(append([]string{}, labels...), "tx")...)
+		}
+
+		if status.Memory.ECCErrors != nil {
+			ecc := status.Memory.ECCErrors
+			ch <- prometheus.MustNewConstMetric(eccErrorsDesc, prometheus.CounterValue,
+				float64(ecc.L1Cache), append(append([]string{}, labels...), "l1_cache")...)
+			ch <- prometheus.MustNewConstMetric(eccErrorsDesc, prometheus.CounterValue,
+				float64(ecc.L2Cache), append(append([]string{}, labels...), "l2_cache")...)
+			ch <- prometheus.MustNewConstMetric(eccErrorsDesc, prometheus.CounterValue,
+				float64(ecc.Global), append(append([]string{}, labels...), "device_memory")...)
+		}
+
+		for _, p := range status.Processes {
+			ch <- prometheus.MustNewConstMetric(processMemoryDesc, prometheus.GaugeValue,
+				float64(p.MemoryUsed)*1024*1024,
+				append(append([]string{}, labels...), strconv.Itoa(int(p.PID)), p.Name)...)
+		}
+
+		for i, l := range d.NVLinks {
+			if l.State != nvml.NVLinkActive {
+				continue
+			}
+			link := strconv.Itoa(i)
+			ch <- prometheus.MustNewConstMetric(nvlinkThroughputDesc, prometheus.CounterValue,
+				float64(l.RX)*1024, append(append([]string{}, labels...), link, l.PeerBusID, "rx")...)
+			ch <- prometheus.MustNewConstMetric(nvlinkThroughputDesc, prometheus.CounterValue,
+				float64(l.TX)*1024, append(append([]string{}, labels...), link, l.PeerBusID, "tx")...)
+		}
+	}
+}
+
+func (c *Collector) status(d *nvml.Device) (*nvml.DeviceStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if status, ok := c.cache[d]; ok && c.cacheTTL > 0 && time.Since(c.cachedAt[d]) < c.cacheTTL {
+		return status, nil
+	}
+
+	status, err := d.Status()
+	if err != nil {
+		return nil, err
+	}
+	c.cache[d] = status
+	c.cachedAt[d] = time.Now()
+	return status, nil
+}
+
+func labelValues(d *nvml.Device) []string {
+	var gi, ci string
+	if d.MIG != nil {
+		gi = strconv.Itoa(int(d.MIG.GI))
+		ci = strconv.Itoa(int(d.MIG.CI))
+	}
+	return []string{d.UUID, minorOf(d), d.Model, d.PCI.BusID, gi, ci}
+}
+
+func minorOf(d *nvml.Device) string {
+	m := minorPattern.FindStringSubmatch(d.Path)
+	if len(m) != 2 {
+		return ""
+	}
+	return m[1]
+}
+
+// Handler returns an http.Handler serving OpenMetrics text for devices on
+// every request, built on its own prometheus.Registry so it doesn't
+// interfere with an application's default one.
+func Handler(devices []*nvml.Device, cacheTTL time.Duration) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(devices, cacheTTL))
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2015-2016, NVIDIA CORPORATION. All rights reserved.
+
+package exporter
+
+import (
+	"testing"
+
+	"nvml"
+)
+
+func TestLabelValues(t *testing.T) {
+	cases := []struct {
+		name string
+		dev  *nvml.Device
+		want []string
+	}{
+		{
+			name: "physical GPU",
+			dev: &nvml.Device{
+				UUID:  "GPU-abc",
+				Path:  "/dev/nvidia0",
+				Model: "Tesla V100",
+				PCI:   nvml.PCIInfo{BusID: "0000:00:1E.0"},
+			},
+			want: []string{"GPU-abc", "0", "Tesla V100", "0000:00:1E.0", "", ""},
+		},
+		{
+			name: "MIG instance",
+			dev: &nvml.Device{
+				UUID:  "MIG-def",
+				Path:  "/proc/driver/nvidia/capabilities/gpu1/mig/gi2/ci3/access",
+				Model: "A100",
+				PCI:   nvml.PCIInfo{BusID: "0000:00:1F.0"},
+				MIG:   &nvml.MIGInfo{GI: 2, CI: 3},
+			},
+			want: []string{"MIG-def", "1", "A100", "0000:00:1F.0", "2", "3"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := labelValues(c.dev)
+			if len(got) != len(c.want) {
+				t.Fatalf("labelValues() = %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("labelValues()[%d] = %q, want %q", i, got[i], c.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMinorOf(t *testing.T) {
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/dev/nvidia0", "0"},
+		{"/dev/nvidia12", "12"},
+		{"/proc/driver/nvidia/capabilities/gpu1/mig/gi2/ci3/access", "1"},
+		{"/dev/nvidiactl", ""},
+	}
+	for _, c := range cases {
+		dev := &nvml.Device{Path: c.path}
+		if got := minorOf(dev); got != c.want {
+			t.Errorf("minorOf(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
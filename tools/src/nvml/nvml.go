@@ -13,19 +13,30 @@ import (
 	"io/ioutil"
 	"strconv"
 	"strings"
+	"time"
+	"unsafe"
 )
 
 const (
 	szDriver   = C.NVML_SYSTEM_DRIVER_VERSION_BUFFER_SIZE
 	szModel    = C.NVML_DEVICE_NAME_BUFFER_SIZE
 	szUUID     = C.NVML_DEVICE_UUID_BUFFER_SIZE
-	szProcs    = 32
 	szProcName = 64
 )
 
 var (
 	ErrCPUAffinity        = errors.New("failed to retrieve CPU affinity")
 	ErrUnsupportedP2PLink = errors.New("unsupported P2P link type")
+
+	// ErrNotSupported is returned, or wrapped via errors.Is, when NVML
+	// reports that a query does not apply to this device (e.g. a Tesla-only
+	// counter queried on a GeForce card, or most metrics queried on a MIG
+	// instance). It is not a failure: callers should treat the associated
+	// value as absent rather than give up on the rest of the call.
+	ErrNotSupported = errors.New("not supported by this device")
+	ErrNoPermission = errors.New("insufficient permissions")
+	ErrGpuLost      = errors.New("GPU has fallen off the bus")
+	ErrUnknown      = errors.New("unknown NVML error")
 )
 
 type P2PLinkType uint
@@ -69,12 +80,46 @@ type ClockInfo struct {
 	Memory uint
 }
 
+type NVLinkState uint
+
+const (
+	NVLinkInactive NVLinkState = iota
+	NVLinkActive
+)
+
+func (s NVLinkState) String() string {
+	if s == NVLinkActive {
+		return "active"
+	}
+	return "inactive"
+}
+
+// NVLink has no Width (lane count) field: NVML exposes no per-link lane-count
+// query, only the NVML_NVLINK_CAP_* booleans (P2P/atomics/SLI-bridge support)
+// and per-generation version, so Bandwidth is derived from Version alone.
+type NVLink struct {
+	Version   uint
+	Bandwidth uint // GB/s, aggregate per-link bandwidth for this NVLink generation
+	State     NVLinkState
+	PeerBusID string
+	RX        uint64 // KB received since the last counter reset
+	TX        uint64 // KB transmitted since the last counter reset
+}
+
 type PCIInfo struct {
 	BusID     string
 	BAR1      uint64
 	Bandwidth uint
 }
 
+type MIGInfo struct {
+	GI                uint
+	CI                uint
+	MemorySliceCount  uint
+	ComputeSliceCount uint
+	ParentUUID        string
+}
+
 type Device struct {
 	handle C.nvmlDevice_t
 
@@ -86,13 +131,15 @@ type Device struct {
 	PCI         PCIInfo
 	Clocks      ClockInfo
 	Topology    []P2PLink
+	NVLinks     []NVLink
+	MIG         *MIGInfo
 }
 
 type UtilizationInfo struct {
 	GPU     uint
 	Memory  uint
-	Encoder uint
-	Decoder uint
+	Encoder *uint
+	Decoder *uint
 }
 
 type PCIThroughputInfo struct {
@@ -101,8 +148,8 @@ type PCIThroughputInfo struct {
 }
 
 type PCIStatusInfo struct {
-	BAR1Used   uint64
-	Throughput PCIThroughputInfo
+	BAR1Used   *uint64
+	Throughput *PCIThroughputInfo
 }
 
 type ECCErrorsInfo struct {
@@ -113,17 +160,51 @@ type ECCErrorsInfo struct {
 
 type MemoryInfo struct {
 	GlobalUsed uint64
-	ECCErrors  ECCErrorsInfo
+	ECCErrors  *ECCErrorsInfo
+}
+
+type ProcessType uint
+
+const (
+	ProcessCompute ProcessType = iota
+	ProcessGraphics
+	ProcessMPS
+)
+
+func (t ProcessType) String() string {
+	switch t {
+	case ProcessGraphics:
+		return "graphics"
+	case ProcessMPS:
+		return "mps"
+	default:
+		return "compute"
+	}
 }
 
 type ProcessInfo struct {
 	PID        uint
 	Name       string
+	Type       ProcessType
 	MemoryUsed uint64
+
+	// The fields below are populated from accounting stats (see
+	// nvmlDeviceGetAccountingStats) when accounting mode is enabled on the
+	// device, and left nil otherwise.
+	GPUUtilization    *uint
+	MemoryUtilization *uint
+	MaxMemoryUsed     *uint64
+	Time              *uint64 // milliseconds the process has spent scheduled on the GPU
+	IsRunning         *bool
 }
 
+// DeviceStatus reports a point-in-time snapshot of a device. Fields that
+// NVML does not support on every device (e.g. encoder/decoder utilization
+// on consumer cards, ECC counters outside Tesla, most metrics on a MIG
+// instance) are pointers and left nil rather than failing the whole call;
+// see ErrNotSupported.
 type DeviceStatus struct {
-	Power       uint
+	Power       *uint
 	Temperature uint
 	Utilization UtilizationInfo
 	Memory      MemoryInfo
@@ -136,14 +217,31 @@ func nvmlErr(ret C.nvmlReturn_t) error {
 	if ret == C.NVML_SUCCESS {
 		return nil
 	}
-	err := C.GoString(C.nvmlErrorString(ret))
-	return fmt.Errorf("nvml: %v", err)
+	msg := C.GoString(C.nvmlErrorString(ret))
+	switch ret {
+	case C.NVML_ERROR_NOT_SUPPORTED:
+		return fmt.Errorf("nvml: %v: %w", msg, ErrNotSupported)
+	case C.NVML_ERROR_NO_PERMISSION:
+		return fmt.Errorf("nvml: %v: %w", msg, ErrNoPermission)
+	case C.NVML_ERROR_GPU_IS_LOST:
+		return fmt.Errorf("nvml: %v: %w", msg, ErrGpuLost)
+	default:
+		return fmt.Errorf("nvml: %v: %w", msg, ErrUnknown)
+	}
 }
 
-func assert(ret C.nvmlReturn_t) {
-	if err := nvmlErr(ret); err != nil {
-		panic(err)
+// optional interprets the return code of an NVML query, reporting ok=false
+// (rather than an error) when NVML says the query does not apply to this
+// device. Callers use this to fill in DeviceStatus fields independently, so
+// one unsupported counter doesn't abort the whole call.
+func optional(ret C.nvmlReturn_t) (ok bool, err error) {
+	if ret == C.NVML_ERROR_NOT_SUPPORTED {
+		return false, nil
+	}
+	if err = nvmlErr(ret); err != nil {
+		return false, err
 	}
+	return true, nil
 }
 
 func Init() error {
@@ -161,8 +259,117 @@ func Shutdown() error {
 func GetDeviceCount() (uint, error) {
 	var n C.uint
 
-	err := nvmlErr(C.nvmlDeviceGetCount(&n))
-	return uint(n), err
+	if err := nvmlErr(C.nvmlDeviceGetCount(&n)); err != nil {
+		return 0, err
+	}
+
+	var total uint
+	for i := C.uint(0); i < n; i++ {
+		var dev C.nvmlDevice_t
+		if err := nvmlErr(C.nvmlDeviceGetHandleByIndex(i, &dev)); err != nil {
+			return 0, err
+		}
+		migs, err := migDeviceCount(dev)
+		if err != nil {
+			return 0, err
+		}
+		if migs == 0 {
+			total++
+		} else {
+			total += migs
+		}
+	}
+	return total, nil
+}
+
+// migDeviceCount returns the number of MIG instances actually configured on
+// dev, or 0 if MIG mode is unsupported, disabled, or not currently enabled.
+func migDeviceCount(dev C.nvmlDevice_t) (uint, error) {
+	indices, err := migDeviceIndices(dev)
+	if err != nil {
+		return 0, err
+	}
+	return uint(len(indices)), nil
+}
+
+// migDeviceIndices returns the index (as passed to
+// nvmlDeviceGetMigDeviceHandleByIndex) of every MIG instance actually
+// configured on dev, in ascending order. Indices up to
+// nvmlDeviceGetMaxMigDeviceCount need not be contiguous: an instance can be
+// destroyed and a later one created without the earlier indices being
+// reused, so every index up to the max is probed rather than assuming the
+// max is the count.
+func migDeviceIndices(dev C.nvmlDevice_t) ([]uint, error) {
+	var mode, pending C.uint
+
+	r := C.nvmlDeviceGetMigMode_dl(dev, &mode, &pending)
+	if r == C.NVML_ERROR_FUNCTION_NOT_FOUND || r == C.NVML_ERROR_NOT_SUPPORTED {
+		return nil, nil
+	}
+	if err := nvmlErr(r); err != nil {
+		return nil, err
+	}
+	if mode != C.NVML_DEVICE_MIG_ENABLE {
+		return nil, nil
+	}
+
+	var max C.uint
+	r = C.nvmlDeviceGetMaxMigDeviceCount_dl(dev, &max)
+	if r == C.NVML_ERROR_FUNCTION_NOT_FOUND {
+		return nil, nil
+	}
+	if err := nvmlErr(r); err != nil {
+		return nil, err
+	}
+
+	var indices []uint
+	for i := C.uint(0); i < max; i++ {
+		var mig C.nvmlDevice_t
+		r := C.nvmlDeviceGetMigDeviceHandleByIndex_dl(dev, i, &mig)
+		if r == C.NVML_ERROR_NOT_FOUND {
+			continue
+		}
+		if err := nvmlErr(r); err != nil {
+			return nil, err
+		}
+		indices = append(indices, uint(i))
+	}
+	return indices, nil
+}
+
+// resolveIndex maps a flattened device index (as counted by GetDeviceCount)
+// to the physical GPU handle that owns it and, if it refers to a MIG
+// instance, that instance's index on the parent. migIdx is -1 for a
+// physical GPU with MIG disabled.
+func resolveIndex(idx uint) (parent C.nvmlDevice_t, migIdx int, err error) {
+	var n C.uint
+	if err = nvmlErr(C.nvmlDeviceGetCount(&n)); err != nil {
+		return
+	}
+
+	remaining := idx
+	for i := C.uint(0); i < n; i++ {
+		var dev C.nvmlDevice_t
+		if err = nvmlErr(C.nvmlDeviceGetHandleByIndex(i, &dev)); err != nil {
+			return
+		}
+		var indices []uint
+		if indices, err = migDeviceIndices(dev); err != nil {
+			return
+		}
+		if len(indices) == 0 {
+			if remaining == 0 {
+				return dev, -1, nil
+			}
+			remaining--
+			continue
+		}
+		if remaining < uint(len(indices)) {
+			return dev, int(indices[remaining]), nil
+		}
+		remaining -= uint(len(indices))
+	}
+	return parent, 0, fmt.Errorf("nvml: device index %d out of range", idx)
 }
 
 func GetDriverVersion() (string, error) {
@@ -180,8 +387,58 @@ var pcieGenToBandwidth = map[int]uint{
 }
 
 func NewDevice(idx uint) (device *Device, err error) {
+	parent, migIdx, err := resolveIndex(idx)
+	if err != nil {
+		return nil, err
+	}
+	if migIdx < 0 {
+		return newDevice(parent, nil)
+	}
+
+	var mig C.nvmlDevice_t
+	if r := C.nvmlDeviceGetMigDeviceHandleByIndex_dl(parent, C.uint(migIdx), &mig); r == C.NVML_ERROR_FUNCTION_NOT_FOUND || r == C.NVML_ERROR_NOT_FOUND {
+		return nil, fmt.Errorf("nvml: MIG instance handle lookup: %w", ErrNotSupported)
+	} else if err = nvmlErr(r); err != nil {
+		return nil, err
+	}
+
+	var gi, ci C.uint
+	var attrs C.nvmlDeviceAttributes_t
+	var parentUUID [szUUID]C.char
+
+	if r := C.nvmlDeviceGetGpuInstanceId_dl(mig, &gi); r == C.NVML_ERROR_FUNCTION_NOT_FOUND {
+		return nil, fmt.Errorf("nvml: MIG GPU instance ID lookup: %w", ErrNotSupported)
+	} else if err = nvmlErr(r); err != nil {
+		return nil, err
+	}
+	if r := C.nvmlDeviceGetComputeInstanceId_dl(mig, &ci); r == C.NVML_ERROR_FUNCTION_NOT_FOUND {
+		return nil, fmt.Errorf("nvml: MIG compute instance ID lookup: %w", ErrNotSupported)
+	} else if err = nvmlErr(r); err != nil {
+		return nil, err
+	}
+	if err = nvmlErr(C.nvmlDeviceGetAttributes_dl(mig, &attrs)); err != nil {
+		return nil, err
+	}
+	if err = nvmlErr(C.nvmlDeviceGetUUID(parent, &parentUUID[0], szUUID)); err != nil {
+		return nil, err
+	}
+
+	return newDevice(mig, &MIGInfo{
+		GI:                uint(gi),
+		CI:                uint(ci),
+		MemorySliceCount:  uint(attrs.gpuInstanceSliceCount),
+		ComputeSliceCount: uint(attrs.computeInstanceSliceCount),
+		ParentUUID:        C.GoString(&parentUUID[0]),
+	})
+}
+
+// newDevice builds a Device from an NVML handle, which may refer either to a
+// physical GPU (mig == nil) or to one of its MIG instances. Properties NVML
+// does not report at MIG granularity (power limits, PCIe link generation,
+// BAR1) are attempted independently via optional and left zero when NVML
+// reports ErrNotSupported, rather than failing the whole call.
+func newDevice(dev C.nvmlDevice_t, mig *MIGInfo) (device *Device, err error) {
 	var (
-		dev   C.nvmlDevice_t
 		model [szModel]C.char
 		uuid  [szUUID]C.char
 		pci   C.nvmlPciInfo_t
@@ -192,23 +449,38 @@ func NewDevice(idx uint) (device *Device, err error) {
 		pciel [2]C.uint
 	)
 
-	defer func() {
-		if r := recover(); r != nil {
-			err = r.(error)
+	if err = nvmlErr(C.nvmlDeviceGetName(dev, &model[0], szModel)); err != nil {
+		return nil, err
+	}
+	if err = nvmlErr(C.nvmlDeviceGetUUID(dev, &uuid[0], szUUID)); err != nil {
+		return nil, err
+	}
+	if err = nvmlErr(C.nvmlDeviceGetPciInfo(dev, &pci)); err != nil {
+		return nil, err
+	}
+	if err = nvmlErr(C.nvmlDeviceGetMinorNumber(dev, &minor)); err != nil {
+		return nil, err
+	}
+	if err = nvmlErr(C.nvmlDeviceGetMaxClockInfo(dev, C.NVML_CLOCK_SM, &clock[0])); err != nil {
+		return nil, err
+	}
+	if err = nvmlErr(C.nvmlDeviceGetMaxClockInfo(dev, C.NVML_CLOCK_MEM, &clock[1])); err != nil {
+		return nil, err
+	}
+
+	if _, oerr := optional(C.nvmlDeviceGetBAR1MemoryInfo(dev, &bar1)); oerr != nil {
+		return nil, oerr
+	}
+	if _, oerr := optional(C.nvmlDeviceGetPowerManagementLimit(dev, &power)); oerr != nil {
+		return nil, oerr
+	}
+	if ok, oerr := optional(C.nvmlDeviceGetMaxPcieLinkGeneration(dev, &pciel[0])); oerr != nil {
+		return nil, oerr
+	} else if ok {
+		if err = nvmlErr(C.nvmlDeviceGetMaxPcieLinkWidth(dev, &pciel[1])); err != nil {
+			return nil, err
 		}
-	}()
-
-	assert(C.nvmlDeviceGetHandleByIndex(C.uint(idx), &dev))
-	assert(C.nvmlDeviceGetName(dev, &model[0], szModel))
-	assert(C.nvmlDeviceGetUUID(dev, &uuid[0], szUUID))
-	assert(C.nvmlDeviceGetPciInfo(dev, &pci))
-	assert(C.nvmlDeviceGetMinorNumber(dev, &minor))
-	assert(C.nvmlDeviceGetBAR1MemoryInfo(dev, &bar1))
-	assert(C.nvmlDeviceGetPowerManagementLimit(dev, &power))
-	assert(C.nvmlDeviceGetMaxClockInfo(dev, C.NVML_CLOCK_SM, &clock[0]))
-	assert(C.nvmlDeviceGetMaxClockInfo(dev, C.NVML_CLOCK_MEM, &clock[1]))
-	assert(C.nvmlDeviceGetMaxPcieLinkGeneration(dev, &pciel[0]))
-	assert(C.nvmlDeviceGetMaxPcieLinkWidth(dev, &pciel[1]))
+	}
 
 	busID := C.GoString(&pci.busId[0])
 	b, err := ioutil.ReadFile(fmt.Sprintf("/sys/bus/pci/devices/%s/numa_node", strings.ToLower(busID)))
@@ -223,11 +495,16 @@ func NewDevice(idx uint) (device *Device, err error) {
 		node = 0 // XXX report node 0 instead of NUMA_NO_NODE
 	}
 
+	path := fmt.Sprintf("/dev/nvidia%d", uint(minor))
+	if mig != nil {
+		path = fmt.Sprintf("/proc/driver/nvidia/capabilities/gpu%d/mig/gi%d/ci%d/access", uint(minor), mig.GI, mig.CI)
+	}
+
 	device = &Device{
 		handle:      dev,
 		Model:       C.GoString(&model[0]),
 		UUID:        C.GoString(&uuid[0]),
-		Path:        fmt.Sprintf("/dev/nvidia%d", uint(minor)),
+		Path:        path,
 		Power:       uint(power / 1000),
 		CPUAffinity: uint(node),
 		PCI: PCIInfo{
@@ -239,52 +516,109 @@ func NewDevice(idx uint) (device *Device, err error) {
 			Cores:  uint(clock[0]),
 			Memory: uint(clock[1]),
 		},
+		MIG: mig,
+	}
+
+	if device.NVLinks, err = GetNVLinks(device); err != nil {
+		return nil, err
 	}
 	return
 }
 
-func (d *Device) Status() (status *DeviceStatus, err error) {
+// getProcesses calls an NVML "get running processes" query (e.g.
+// nvmlDeviceGetComputeRunningProcesses) first with a nil buffer to learn the
+// required size, then again with a buffer of exactly that size, so results
+// aren't silently truncated on a busy MPS/shared GPU.
+func getProcesses(dev C.nvmlDevice_t, query func(C.nvmlDevice_t, *C.uint, *C.nvmlProcessInfo_t) C.nvmlReturn_t) ([]C.nvmlProcessInfo_t, error) {
+	var n C.uint
+	r := query(dev, &n, nil)
+	// With any process actually running, the nil-buffer probe reports the
+	// required count via NVML_ERROR_INSUFFICIENT_SIZE rather than success;
+	// that's expected here, not a failure.
+	if r != C.NVML_ERROR_INSUFFICIENT_SIZE {
+		if ok, err := optional(r); err != nil {
+			return nil, err
+		} else if !ok || n == 0 {
+			return nil, nil
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	procs := make([]C.nvmlProcessInfo_t, n)
+	if err := nvmlErr(query(dev, &n, &procs[0])); err != nil {
+		return nil, err
+	}
+	return procs[:n], nil
+}
+
+// buildProcessInfo resolves a raw NVML process entry to a ProcessInfo,
+// filling in accounting stats when accounting is enabled.
+func buildProcessInfo(dev C.nvmlDevice_t, p C.nvmlProcessInfo_t, typ ProcessType, accounting bool) (ProcessInfo, error) {
+	var procname [szProcName]C.char
+	if err := nvmlErr(C.nvmlSystemGetProcessName(p.pid, &procname[0], szProcName)); err != nil {
+		return ProcessInfo{}, err
+	}
+
+	info := ProcessInfo{
+		PID:        uint(p.pid),
+		Name:       C.GoString(&procname[0]),
+		Type:       typ,
+		MemoryUsed: uint64(p.usedGpuMemory) / (1024 * 1024),
+	}
+	if !accounting {
+		return info, nil
+	}
+
+	var stats C.nvmlAccountingStats_t
+	if ok, err := optional(C.nvmlDeviceGetAccountingStats_dl(dev, p.pid, &stats)); err != nil {
+		return ProcessInfo{}, err
+	} else if ok {
+		gpuUtil := uint(stats.gpuUtilization)
+		memUtil := uint(stats.memoryUtilization)
+		maxMem := uint64(stats.maxMemoryUsage) / (1024 * 1024)
+		wallTime := uint64(stats.time)
+		running := stats.isRunning != 0
+
+		info.GPUUtilization = &gpuUtil
+		info.MemoryUtilization = &memUtil
+		info.MaxMemoryUsed = &maxMem
+		info.Time = &wallTime
+		info.IsRunning = &running
+	}
+	return info, nil
+}
+
+func (d *Device) Status() (*DeviceStatus, error) {
 	var (
-		power      C.uint
-		temp       C.uint
-		usage      C.nvmlUtilization_t
-		encoder    [2]C.uint
-		decoder    [2]C.uint
-		mem        C.nvmlMemory_t
-		ecc        [3]C.ulonglong
-		clock      [2]C.uint
-		bar1       C.nvmlBAR1Memory_t
-		throughput [2]C.uint
-		procname   [szProcName]C.char
-		procs      [szProcs]C.nvmlProcessInfo_t
-		nprocs     = C.uint(szProcs)
+		temp  C.uint
+		usage C.nvmlUtilization_t
+		mem   C.nvmlMemory_t
+		clock [2]C.uint
 	)
 
-	defer func() {
-		if r := recover(); r != nil {
-			err = r.(error)
-		}
-	}()
-
-	assert(C.nvmlDeviceGetPowerUsage(d.handle, &power))
-	assert(C.nvmlDeviceGetTemperature(d.handle, C.NVML_TEMPERATURE_GPU, &temp))
-	assert(C.nvmlDeviceGetUtilizationRates(d.handle, &usage))
-	assert(C.nvmlDeviceGetEncoderUtilization(d.handle, &encoder[0], &encoder[1]))
-	assert(C.nvmlDeviceGetDecoderUtilization(d.handle, &decoder[0], &decoder[1]))
-	assert(C.nvmlDeviceGetMemoryInfo(d.handle, &mem))
-	assert(C.nvmlDeviceGetClockInfo(d.handle, C.NVML_CLOCK_SM, &clock[0]))
-	assert(C.nvmlDeviceGetClockInfo(d.handle, C.NVML_CLOCK_MEM, &clock[1]))
-	assert(C.nvmlDeviceGetBAR1MemoryInfo(d.handle, &bar1))
-	assert(C.nvmlDeviceGetComputeRunningProcesses(d.handle, &nprocs, &procs[0]))
-
-	status = &DeviceStatus{
-		Power:       uint(power / 1000),
+	if err := nvmlErr(C.nvmlDeviceGetTemperature(d.handle, C.NVML_TEMPERATURE_GPU, &temp)); err != nil {
+		return nil, err
+	}
+	if err := nvmlErr(C.nvmlDeviceGetUtilizationRates(d.handle, &usage)); err != nil {
+		return nil, err
+	}
+	if err := nvmlErr(C.nvmlDeviceGetMemoryInfo(d.handle, &mem)); err != nil {
+		return nil, err
+	}
+	if err := nvmlErr(C.nvmlDeviceGetClockInfo(d.handle, C.NVML_CLOCK_SM, &clock[0])); err != nil {
+		return nil, err
+	}
+	if err := nvmlErr(C.nvmlDeviceGetClockInfo(d.handle, C.NVML_CLOCK_MEM, &clock[1])); err != nil {
+		return nil, err
+	}
+
+	status := &DeviceStatus{
 		Temperature: uint(temp),
 		Utilization: UtilizationInfo{
-			GPU:     uint(usage.gpu),
-			Memory:  uint(usage.memory),
-			Encoder: uint(encoder[0]),
-			Decoder: uint(decoder[0]),
+			GPU:    uint(usage.gpu),
+			Memory: uint(usage.memory),
 		},
 		Memory: MemoryInfo{
 			GlobalUsed: uint64(mem.used / (1024 * 1024)),
@@ -293,37 +627,104 @@ func (d *Device) Status() (status *DeviceStatus, err error) {
 			Cores:  uint(clock[0]),
 			Memory: uint(clock[1]),
 		},
-		PCI: PCIStatusInfo{
-			BAR1Used: uint64(bar1.bar1Used / (1024 * 1024)),
-		},
 	}
 
-	r := C.nvmlDeviceGetMemoryErrorCounter(d.handle, C.NVML_MEMORY_ERROR_TYPE_UNCORRECTED, C.NVML_VOLATILE_ECC,
-		C.NVML_MEMORY_LOCATION_L1_CACHE, &ecc[0])
-	if r != C.NVML_ERROR_NOT_SUPPORTED { // only supported on Tesla cards
-		assert(r)
-		assert(C.nvmlDeviceGetMemoryErrorCounter(d.handle, C.NVML_MEMORY_ERROR_TYPE_UNCORRECTED, C.NVML_VOLATILE_ECC,
-			C.NVML_MEMORY_LOCATION_L2_CACHE, &ecc[1]))
-		assert(C.nvmlDeviceGetMemoryErrorCounter(d.handle, C.NVML_MEMORY_ERROR_TYPE_UNCORRECTED, C.NVML_VOLATILE_ECC,
-			C.NVML_MEMORY_LOCATION_DEVICE_MEMORY, &ecc[2]))
-		status.Memory.ECCErrors = ECCErrorsInfo{uint64(ecc[0]), uint64(ecc[1]), uint64(ecc[2])}
+	var power C.uint
+	if ok, err := optional(C.nvmlDeviceGetPowerUsage(d.handle, &power)); err != nil {
+		return nil, err
+	} else if ok {
+		p := uint(power / 1000)
+		status.Power = &p
 	}
 
-	r = C.nvmlDeviceGetPcieThroughput(d.handle, C.NVML_PCIE_UTIL_RX_BYTES, &throughput[0])
-	if r != C.NVML_ERROR_NOT_SUPPORTED { // only supported on Maxwell or newer
-		assert(r)
-		assert(C.nvmlDeviceGetPcieThroughput(d.handle, C.NVML_PCIE_UTIL_TX_BYTES, &throughput[1]))
-		status.PCI.Throughput = PCIThroughputInfo{uint(throughput[0]) / 1000, uint(throughput[1]) / 1000}
+	var encoder [2]C.uint
+	if ok, err := optional(C.nvmlDeviceGetEncoderUtilization(d.handle, &encoder[0], &encoder[1])); err != nil {
+		return nil, err
+	} else if ok {
+		e := uint(encoder[0])
+		status.Utilization.Encoder = &e
 	}
 
-	status.Processes = make([]ProcessInfo, nprocs)
-	for i := range status.Processes {
-		status.Processes[i].PID = uint(procs[i].pid)
-		assert(C.nvmlSystemGetProcessName(procs[i].pid, &procname[0], szProcName))
-		status.Processes[i].Name = C.GoString(&procname[0])
-		status.Processes[i].MemoryUsed = uint64(procs[i].usedGpuMemory) / (1024 * 1024)
+	var decoder [2]C.uint
+	if ok, err := optional(C.nvmlDeviceGetDecoderUtilization(d.handle, &decoder[0], &decoder[1])); err != nil {
+		return nil, err
+	} else if ok {
+		dd := uint(decoder[0])
+		status.Utilization.Decoder = &dd
 	}
-	return
+
+	var bar1 C.nvmlBAR1Memory_t
+	if ok, err := optional(C.nvmlDeviceGetBAR1MemoryInfo(d.handle, &bar1)); err != nil {
+		return nil, err
+	} else if ok {
+		used := uint64(bar1.bar1Used / (1024 * 1024))
+		status.PCI.BAR1Used = &used
+	}
+
+	var ecc [3]C.ulonglong
+	if ok, err := optional(C.nvmlDeviceGetMemoryErrorCounter(d.handle, C.NVML_MEMORY_ERROR_TYPE_UNCORRECTED,
+		C.NVML_VOLATILE_ECC, C.NVML_MEMORY_LOCATION_L1_CACHE, &ecc[0])); err != nil {
+		return nil, err
+	} else if ok {
+		if err := nvmlErr(C.nvmlDeviceGetMemoryErrorCounter(d.handle, C.NVML_MEMORY_ERROR_TYPE_UNCORRECTED,
+			C.NVML_VOLATILE_ECC, C.NVML_MEMORY_LOCATION_L2_CACHE, &ecc[1])); err != nil {
+			return nil, err
+		}
+		if err := nvmlErr(C.nvmlDeviceGetMemoryErrorCounter(d.handle, C.NVML_MEMORY_ERROR_TYPE_UNCORRECTED,
+			C.NVML_VOLATILE_ECC, C.NVML_MEMORY_LOCATION_DEVICE_MEMORY, &ecc[2])); err != nil {
+			return nil, err
+		}
+		status.Memory.ECCErrors = &ECCErrorsInfo{uint64(ecc[0]), uint64(ecc[1]), uint64(ecc[2])}
+	}
+
+	var throughput [2]C.uint
+	if ok, err := optional(C.nvmlDeviceGetPcieThroughput(d.handle, C.NVML_PCIE_UTIL_RX_BYTES, &throughput[0])); err != nil {
+		return nil, err
+	} else if ok {
+		if err := nvmlErr(C.nvmlDeviceGetPcieThroughput(d.handle, C.NVML_PCIE_UTIL_TX_BYTES, &throughput[1])); err != nil {
+			return nil, err
+		}
+		status.PCI.Throughput = &PCIThroughputInfo{uint(throughput[0]) / 1000, uint(throughput[1]) / 1000}
+	}
+
+	accounting := false
+	var mode C.nvmlEnableState_t
+	if ok, err := optional(C.nvmlDeviceGetAccountingMode_dl(d.handle, &mode)); err != nil {
+		return nil, err
+	} else if ok && mode == C.NVML_FEATURE_ENABLED {
+		accounting = true
+	}
+
+	compute, err := getProcesses(d.handle, C.nvmlDeviceGetComputeRunningProcesses)
+	if err != nil {
+		return nil, err
+	}
+	graphics, err := getProcesses(d.handle, C.nvmlDeviceGetGraphicsRunningProcesses_dl)
+	if err != nil {
+		return nil, err
+	}
+	mps, err := getProcesses(d.handle, C.nvmlDeviceGetMPSComputeRunningProcesses_dl)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, batch := range []struct {
+		procs []C.nvmlProcessInfo_t
+		typ   ProcessType
+	}{
+		{compute, ProcessCompute},
+		{graphics, ProcessGraphics},
+		{mps, ProcessMPS},
+	} {
+		for _, p := range batch.procs {
+			info, err := buildProcessInfo(d.handle, p, batch.typ, accounting)
+			if err != nil {
+				return nil, err
+			}
+			status.Processes = append(status.Processes, info)
+		}
+	}
+	return status, nil
 }
 
 func GetP2PLink(dev1, dev2 *Device) (link P2PLinkType, err error) {
@@ -355,14 +756,171 @@ func GetP2PLink(dev1, dev2 *Device) (link P2PLinkType, err error) {
 	return
 }
 
-func GetDevicePath(idx uint) (path string, err error) {
-	var dev C.nvmlDevice_t
-	var minor C.uint
+// nvlinkVersionToBandwidth gives each NVLink generation's aggregate per-link
+// bandwidth. NVML exposes no lane-count query, so this is the best available
+// proxy for a link's bandwidth short of the number nvidia-smi itself hard-codes
+// per generation.
+var nvlinkVersionToBandwidth = map[uint]uint{
+	1: 20,  // GB/s, Pascal
+	2: 25,  // GB/s, Volta/Turing
+	3: 50,  // GB/s, Ampere
+	4: 100, // GB/s, Hopper
+}
+
+const nvlinkMaxLinks = C.NVML_NVLINK_MAX_LINKS
+
+func getNVLink(dev *Device, link C.uint) (*NVLink, error) {
+	var state C.nvmlEnableState_t
 
-	err = nvmlErr(C.nvmlDeviceGetHandleByIndex(C.uint(idx), &dev))
+	r := C.nvmlDeviceGetNvLinkState_dl(dev.handle, link, &state)
+	if r == C.NVML_ERROR_FUNCTION_NOT_FOUND || r == C.NVML_ERROR_INVALID_ARGUMENT {
+		return nil, nil
+	}
+	if ok, err := optional(r); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, nil
+	}
+	if state != C.NVML_FEATURE_ENABLED {
+		return &NVLink{State: NVLinkInactive}, nil
+	}
+
+	var version C.uint
+	if err := nvmlErr(C.nvmlDeviceGetNvLinkVersion_dl(dev.handle, link, &version)); err != nil {
+		return nil, err
+	}
+
+	var pci C.nvmlPciInfo_t
+	if err := nvmlErr(C.nvmlDeviceGetNvLinkRemotePciInfo_dl(dev.handle, link, &pci)); err != nil {
+		return nil, err
+	}
+
+	var rx, tx C.ulonglong
+	if err := nvmlErr(C.nvmlDeviceGetNvLinkUtilizationCounter_dl(dev.handle, link, 0, &rx, &tx)); err != nil {
+		return nil, err
+	}
+
+	return &NVLink{
+		Version:   uint(version),
+		Bandwidth: nvlinkVersionToBandwidth[uint(version)],
+		State:     NVLinkActive,
+		PeerBusID: C.GoString(&pci.busId[0]),
+		RX:        uint64(rx),
+		TX:        uint64(tx),
+	}, nil
+}
+
+// GetNVLinks returns the per-link NVLink state for dev, one entry for every
+// link index NVML exposes, including inactive links. It returns an empty
+// slice, not an error, on GPUs or drivers without NVLink support.
+func GetNVLinks(dev *Device) ([]NVLink, error) {
+	var links []NVLink
+	for i := C.uint(0); i < nvlinkMaxLinks; i++ {
+		link, err := getNVLink(dev, i)
+		if err != nil {
+			return nil, err
+		}
+		if link == nil {
+			break
+		}
+		links = append(links, *link)
+	}
+	return links, nil
+}
+
+// GetNVLink reports the number of active NVLinks directly connecting dev1
+// and dev2, and their aggregate bandwidth in GB/s.
+func GetNVLink(dev1, dev2 *Device) (links uint, bandwidth uint, err error) {
+	nvlinks, err := GetNVLinks(dev1)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, l := range nvlinks {
+		if l.State == NVLinkActive && strings.EqualFold(l.PeerBusID, dev2.PCI.BusID) {
+			links++
+			bandwidth += l.Bandwidth
+		}
+	}
+	return links, bandwidth, nil
+}
+
+type UtilizationSample struct {
+	Timestamp time.Time
+	GPU       uint
+	Memory    uint
+}
+
+// GetUtilizationSamples returns GPU and memory utilization values NVML has
+// buffered internally since the given time (the zero Time means "since
+// device init"), via nvmlDeviceGetSamples, so a caller polling slower than
+// NVML's own sampling rate doesn't miss transient spikes between polls. It
+// returns ErrNotSupported on drivers/GPUs that don't buffer samples, in
+// which case callers should fall back to direct polling via Status().
+func (d *Device) GetUtilizationSamples(since time.Time) ([]UtilizationSample, error) {
+	var lastSeen C.ulonglong
+	if !since.IsZero() {
+		lastSeen = C.ulonglong(since.UnixMicro())
+	}
+
+	var valueType C.nvmlValueType_t
+	var count C.uint
+	r := C.nvmlDeviceGetSamples_dl(d.handle, C.NVML_GPU_UTILIZATION_SAMPLES, lastSeen, &valueType, &count, nil)
+	if r == C.NVML_ERROR_FUNCTION_NOT_FOUND {
+		return nil, ErrNotSupported
+	}
+	if ok, err := optional(r); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrNotSupported
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	gpu := make([]C.nvmlSample_t, count)
+	if err := nvmlErr(C.nvmlDeviceGetSamples_dl(d.handle, C.NVML_GPU_UTILIZATION_SAMPLES, lastSeen, &valueType, &count, &gpu[0])); err != nil {
+		return nil, err
+	}
+
+	var memCount C.uint
+	r = C.nvmlDeviceGetSamples_dl(d.handle, C.NVML_MEMORY_UTILIZATION_SAMPLES, lastSeen, &valueType, &memCount, nil)
+	if ok, err := optional(r); err != nil {
+		return nil, err
+	} else if !ok {
+		memCount = 0
+	}
+
+	var mem []C.nvmlSample_t
+	if memCount > 0 {
+		mem = make([]C.nvmlSample_t, memCount)
+		if err := nvmlErr(C.nvmlDeviceGetSamples_dl(d.handle, C.NVML_MEMORY_UTILIZATION_SAMPLES, lastSeen, &valueType, &memCount, &mem[0])); err != nil {
+			return nil, err
+		}
+	}
+
+	samples := make([]UtilizationSample, count)
+	for i := range samples {
+		samples[i].Timestamp = time.UnixMicro(int64(gpu[i].timeStamp))
+		samples[i].GPU = uint(*(*C.uint)(unsafe.Pointer(&gpu[i].sampleValue)))
+		if C.uint(i) < memCount {
+			samples[i].Memory = uint(*(*C.uint)(unsafe.Pointer(&mem[i].sampleValue)))
+		}
+	}
+	return samples, nil
+}
+
+// GetDevicePath returns the /dev node for the device at the MIG-flattened
+// index idx, using the same idx->handle resolution as NewDevice so callers
+// iterating 0..GetDeviceCount() get the path for the GPU they actually asked
+// for, not the physical GPU at that raw index. MIG instances share their
+// parent GPU's /dev node, since MIG does not create separate device nodes.
+func GetDevicePath(idx uint) (path string, err error) {
+	dev, _, err := resolveIndex(idx)
 	if err != nil {
 		return
 	}
+
+	var minor C.uint
 	err = nvmlErr(C.nvmlDeviceGetMinorNumber(dev, &minor))
 	path = fmt.Sprintf("/dev/nvidia%d", uint(minor))
 	return
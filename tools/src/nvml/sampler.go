@@ -0,0 +1,314 @@
+// Copyright (c) 2015-2016, NVIDIA CORPORATION. All rights reserved.
+
+package nvml
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SamplerConfig configures a Sampler. Snapshot covers the most recent
+// Window/Interval samples of a device. When a poll returns several buffered
+// NVML samples, those samples span less than Window; samples are not evicted
+// by age.
+type SamplerConfig struct {
+	Interval time.Duration // how often to poll each device
+	Window   time.Duration // history for Snapshot, kept as Window/Interval samples per device
+}
+
+// Sample is a single point-in-time reading taken by a Sampler.
+type Sample struct {
+	Timestamp   time.Time
+	Power       *uint
+	Temperature uint
+	Utilization UtilizationInfo
+	Clocks      ClockInfo
+	PCI         PCIStatusInfo
+}
+
+// Stats summarizes a series of readings over a Sampler's rolling window.
+type Stats struct {
+	Min, Max, Avg, P50, P95 float64
+}
+
+// Snapshot summarizes the samples retained for a device at the time it was
+// taken.
+type Snapshot struct {
+	Count             int
+	GPUUtilization    Stats
+	MemoryUtilization Stats
+	Power             Stats
+	Temperature       Stats
+	SMClock           Stats
+	MemClock          Stats
+	PCIThroughputRX   Stats
+	PCIThroughputTX   Stats
+}
+
+// ring is a fixed-capacity, single-writer/multi-reader ring buffer of
+// Samples. Slots are individually addressed atomic.Values, so pushing a
+// sample and reading a snapshot never take a lock.
+type ring struct {
+	buf   []atomic.Value // *Sample
+	count uint64
+}
+
+func newRing(capacity int) *ring {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &ring{buf: make([]atomic.Value, capacity)}
+}
+
+func (r *ring) push(s Sample) {
+	i := atomic.AddUint64(&r.count, 1) - 1
+	r.buf[i%uint64(len(r.buf))].Store(&s)
+}
+
+func (r *ring) samples() []Sample {
+	n := atomic.LoadUint64(&r.count)
+	capacity := uint64(len(r.buf))
+	size := n
+	if size > capacity {
+		size = capacity
+	}
+	out := make([]Sample, 0, size)
+	for i := n - size; i < n; i++ {
+		if v := r.buf[i%capacity].Load(); v != nil {
+			out = append(out, *v.(*Sample))
+		}
+	}
+	return out
+}
+
+// Sampler periodically polls a set of devices and retains a rolling window
+// of samples per device.
+type Sampler struct {
+	devices []*Device
+	config  SamplerConfig
+	rings   map[*Device]*ring
+
+	mu       sync.Mutex
+	lastSeen map[*Device]time.Time
+	subs     []chan Sample
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewSampler creates a Sampler for devices. Sampling does not start until
+// Start is called.
+func NewSampler(devices []*Device, config SamplerConfig) *Sampler {
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.Window <= 0 {
+		config.Window = time.Minute
+	}
+
+	capacity := int(config.Window / config.Interval)
+	rings := make(map[*Device]*ring, len(devices))
+	for _, d := range devices {
+		rings[d] = newRing(capacity)
+	}
+
+	return &Sampler{
+		devices:  devices,
+		config:   config,
+		rings:    rings,
+		lastSeen: make(map[*Device]time.Time, len(devices)),
+	}
+}
+
+// Start polls every device at config.Interval in the background until ctx
+// is canceled or Stop is called.
+func (s *Sampler) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.poll()
+			}
+		}
+	}()
+}
+
+// Stop halts sampling and closes every channel handed out by Subscribe.
+func (s *Sampler) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.subs {
+		close(ch)
+	}
+	s.subs = nil
+}
+
+func (s *Sampler) poll() {
+	for _, d := range s.devices {
+		samples, ok := s.pollDevice(d)
+		if !ok {
+			continue
+		}
+		for _, sample := range samples {
+			s.rings[d].push(sample)
+			s.publish(sample)
+		}
+	}
+}
+
+// pollDevice returns every sample Device.GetUtilizationSamples buffered
+// since the last poll (each carrying this poll's Status() for fields NVML
+// doesn't buffer, such as power and temperature), or falls back to a single
+// direct Status() sample when buffering isn't supported.
+func (s *Sampler) pollDevice(d *Device) ([]Sample, bool) {
+	s.mu.Lock()
+	since := s.lastSeen[d]
+	s.mu.Unlock()
+
+	if buffered, err := d.GetUtilizationSamples(since); err == nil && len(buffered) > 0 {
+		status, err := d.Status()
+		if err != nil {
+			return nil, false
+		}
+
+		samples := make([]Sample, len(buffered))
+		for i, u := range buffered {
+			sample := sampleFromStatus(u.Timestamp, status)
+			sample.Utilization.GPU = u.GPU
+			sample.Utilization.Memory = u.Memory
+			samples[i] = sample
+		}
+
+		s.mu.Lock()
+		s.lastSeen[d] = buffered[len(buffered)-1].Timestamp
+		s.mu.Unlock()
+		return samples, true
+	}
+
+	status, err := d.Status()
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	s.lastSeen[d] = now
+	s.mu.Unlock()
+	return []Sample{sampleFromStatus(now, status)}, true
+}
+
+func sampleFromStatus(ts time.Time, status *DeviceStatus) Sample {
+	return Sample{
+		Timestamp:   ts,
+		Power:       status.Power,
+		Temperature: status.Temperature,
+		Utilization: status.Utilization,
+		Clocks:      status.Clocks,
+		PCI:         status.PCI,
+	}
+}
+
+func (s *Sampler) publish(sample Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.subs {
+		select {
+		case ch <- sample:
+		default: // drop if the subscriber isn't keeping up
+		}
+	}
+}
+
+// Subscribe returns a channel that receives each sample as it is taken.
+// The channel buffers 16 samples; while it is full, new samples are dropped
+// for that subscriber. The channel is closed when Stop is called.
+func (s *Sampler) Subscribe() <-chan Sample {
+	ch := make(chan Sample, 16)
+	s.mu.Lock()
+	s.subs = append(s.subs, ch)
+	s.mu.Unlock()
+	return ch
+}
+
+// Snapshot summarizes the rolling window of samples currently retained for
+// dev.
+func (s *Sampler) Snapshot(dev *Device) Snapshot {
+	r, ok := s.rings[dev]
+	if !ok {
+		return Snapshot{}
+	}
+	samples := r.samples()
+
+	var gpu, mem, power, temp, sm, memClock, rx, tx []float64
+	for _, sa := range samples {
+		gpu = append(gpu, float64(sa.Utilization.GPU))
+		mem = append(mem, float64(sa.Utilization.Memory))
+		if sa.Power != nil {
+			power = append(power, float64(*sa.Power))
+		}
+		temp = append(temp, float64(sa.Temperature))
+		sm = append(sm, float64(sa.Clocks.Cores))
+		memClock = append(memClock, float64(sa.Clocks.Memory))
+		if sa.PCI.Throughput != nil {
+			rx = append(rx, float64(sa.PCI.Throughput.RX))
+			tx = append(tx, float64(sa.PCI.Throughput.TX))
+		}
+	}
+
+	return Snapshot{
+		Count:             len(samples),
+		GPUUtilization:    computeStats(gpu),
+		MemoryUtilization: computeStats(mem),
+		Power:             computeStats(power),
+		Temperature:       computeStats(temp),
+		SMClock:           computeStats(sm),
+		MemClock:          computeStats(memClock),
+		PCIThroughputRX:   computeStats(rx),
+		PCIThroughputTX:   computeStats(tx),
+	}
+}
+
+func computeStats(values []float64) Stats {
+	if len(values) == 0 {
+		return Stats{}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+
+	return Stats{
+		Min: sorted[0],
+		Max: sorted[len(sorted)-1],
+		Avg: sum / float64(len(sorted)),
+		P50: percentile(sorted, 0.50),
+		P95: percentile(sorted, 0.95),
+	}
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	idx := int(p*float64(len(sorted)-1) + 0.5)
+	return sorted[idx]
+}
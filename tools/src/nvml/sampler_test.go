@@ -0,0 +1,84 @@
+// Copyright (c) 2015-2016, NVIDIA CORPORATION. All rights reserved.
+
+package nvml
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComputeStats(t *testing.T) {
+	cases := []struct {
+		name   string
+		values []float64
+		want   Stats
+	}{
+		{"empty", nil, Stats{}},
+		{"single", []float64{42}, Stats{Min: 42, Max: 42, Avg: 42, P50: 42, P95: 42}},
+		{
+			"ascending",
+			[]float64{10, 20, 30, 40, 50},
+			Stats{Min: 10, Max: 50, Avg: 30, P50: 30, P95: 50},
+		},
+		{
+			"unsorted",
+			[]float64{50, 10, 30},
+			Stats{Min: 10, Max: 50, Avg: 30, P50: 30, P95: 50},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := computeStats(c.values); got != c.want {
+				t.Errorf("computeStats(%v) = %+v, want %+v", c.values, got, c.want)
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{10, 20, 30, 40, 50}
+	cases := []struct {
+		p    float64
+		want float64
+	}{
+		{0, 10},
+		{0.5, 30},
+		{0.95, 50},
+		{1, 50},
+	}
+	for _, c := range cases {
+		if got := percentile(sorted, c.p); got != c.want {
+			t.Errorf("percentile(%v, %v) = %v, want %v", sorted, c.p, got, c.want)
+		}
+	}
+}
+
+func TestRingPushAndSamples(t *testing.T) {
+	r := newRing(3)
+	for i := 0; i < 5; i++ {
+		r.push(Sample{Temperature: uint(i)})
+	}
+
+	// only the last `capacity` pushes survive
+	if got, want := temperatures(r.samples()), []uint{2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("samples() = %v, want %v", got, want)
+	}
+}
+
+func TestRingSamplesBeforeFull(t *testing.T) {
+	r := newRing(3)
+	r.push(Sample{Temperature: 1})
+	r.push(Sample{Temperature: 2})
+
+	if got, want := temperatures(r.samples()), []uint{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("samples() = %v, want %v", got, want)
+	}
+}
+
+func temperatures(samples []Sample) []uint {
+	out := make([]uint, len(samples))
+	for i, s := range samples {
+		out[i] = s.Temperature
+	}
+	return out
+}